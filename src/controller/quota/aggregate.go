@@ -0,0 +1,343 @@
+// Copyright Project Harbor Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/goharbor/harbor/src/lib/log"
+	"github.com/goharbor/harbor/src/lib/q"
+	"github.com/goharbor/harbor/src/pkg/quota/types"
+)
+
+// aggregateReference is the Quota.Reference value used for aggregate
+// quotas, following the same (reference, referenceID) shape as an
+// ordinary project quota: reference is always "aggregate" and
+// referenceID is the aggregate quota's own id, formatted as a string.
+const aggregateReference = "aggregate"
+
+// AggregateSelector picks the member references (today, always projects)
+// whose usage rolls up into an aggregate quota, mirroring how
+// ClusterResourceQuota in Kubernetes selects namespaces by label. Fields
+// are ANDed; a zero-value selector matches nothing, to avoid an
+// empty/forgotten selector silently aggregating the entire instance.
+type AggregateSelector struct {
+	// ProjectIDs, when non-empty, restricts membership to this explicit
+	// list of project IDs.
+	ProjectIDs []int64 `json:"project_ids,omitempty"`
+	// OwnerID, when set, restricts membership to projects owned by this
+	// user id.
+	OwnerID *int64 `json:"owner_id,omitempty"`
+	// Metadata, when non-empty, restricts membership to projects whose
+	// metadata contains every given key/value pair, e.g.
+	// {"team": "payments"}.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Matches reports whether member belongs to the aggregate this selector
+// is attached to.
+func (s AggregateSelector) Matches(member AggregateMember) bool {
+	if len(s.ProjectIDs) > 0 {
+		found := false
+		for _, id := range s.ProjectIDs {
+			if id == member.ProjectID() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if s.OwnerID != nil && member.OwnerID() != *s.OwnerID {
+		return false
+	}
+
+	for k, v := range s.Metadata {
+		if member.Metadata()[k] != v {
+			return false
+		}
+	}
+
+	return len(s.ProjectIDs) > 0 || s.OwnerID != nil || len(s.Metadata) > 0
+}
+
+// AggregateMember is the minimal view of a project an aggregate quota's
+// selector is matched against.
+type AggregateMember interface {
+	ProjectID() int64
+	OwnerID() int64
+	Metadata() map[string]string
+}
+
+func aggregateSelectorKey(id int64) string {
+	return fmt.Sprintf("quota:%d:aggregate-selector", id)
+}
+
+// AggregateSelector returns the selector configured for the aggregate
+// quota identified by id, and false if none has been set yet.
+func (c *controller) AggregateSelector(ctx context.Context, id int64) (AggregateSelector, bool, error) {
+	var selector AggregateSelector
+	ok, err := loadCachedMetadata(ctx, id, metadataKindAggregateSelector, aggregateSelectorKey(id), &selector)
+	if err != nil {
+		return AggregateSelector{}, false, err
+	}
+
+	return selector, ok, nil
+}
+
+// SetAggregateSelector sets the selector for the aggregate quota
+// identified by id.
+func (c *controller) SetAggregateSelector(ctx context.Context, id int64, selector AggregateSelector) error {
+	return storeCachedMetadata(ctx, id, metadataKindAggregateSelector, aggregateSelectorKey(id), selector)
+}
+
+// MatchingMembers returns the subset of candidates that belong to the
+// aggregate quota identified by id. It's the in-memory building block for
+// the "list member projects" REST endpoint; the endpoint itself still
+// needs to supply the candidate projects (e.g. all projects, or those
+// owned by the caller) since this package has no project listing of its
+// own.
+func (c *controller) MatchingMembers(ctx context.Context, id int64, candidates []AggregateMember) ([]AggregateMember, error) {
+	selector, ok, err := c.AggregateSelector(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	var members []AggregateMember
+	for _, candidate := range candidates {
+		if selector.Matches(candidate) {
+			members = append(members, candidate)
+		}
+	}
+
+	return members, nil
+}
+
+// reserveAggregates reserves resources against every aggregate quota
+// whose selector matches member. If any of them would be exceeded, it
+// unreserves the ones it already succeeded on and returns the error, so
+// the caller can unreserve the project-level quota in turn and fail the
+// whole request atomically.
+func (c *controller) reserveAggregates(ctx context.Context, resources types.ResourceList, member AggregateMember) error {
+	if member == nil {
+		return nil
+	}
+
+	ids, err := c.matchingAggregateIDs(ctx, member)
+	if err != nil {
+		return err
+	}
+
+	return reserveAggregateSet(ids,
+		func(id int64) error {
+			return c.reserveResources(ctx, aggregateReference, strconv.FormatInt(id, 10), resources, nil)
+		},
+		func(id int64) {
+			if err := c.unreserveResources(ctx, aggregateReference, strconv.FormatInt(id, 10), resources, nil); err != nil {
+				log.G(ctx).Warningf("unreserve aggregate quota %d failed, error: %v", id, err)
+			}
+		},
+	)
+}
+
+// matchingAggregateIDs returns the IDs of every aggregate quota whose
+// selector matches member.
+func (c *controller) matchingAggregateIDs(ctx context.Context, member AggregateMember) ([]int64, error) {
+	aggregates, err := c.aggregateQuotas(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for _, agg := range aggregates {
+		selector, ok, err := c.AggregateSelector(ctx, agg.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || !selector.Matches(member) {
+			continue
+		}
+
+		ids = append(ids, agg.ID)
+	}
+
+	return ids, nil
+}
+
+// reserveAggregateSet reserves against every id in order via reserve. If
+// one fails, it unreserves every id that had already succeeded, in
+// reverse order, and returns that error - so a partial failure never
+// leaves some aggregate quotas holding a reservation for a request that
+// overall didn't go through.
+func reserveAggregateSet(ids []int64, reserve func(id int64) error, unreserve func(id int64)) error {
+	var reserved []int64
+
+	for _, id := range ids {
+		if err := reserve(id); err != nil {
+			for i := len(reserved) - 1; i >= 0; i-- {
+				unreserve(reserved[i])
+			}
+			return err
+		}
+
+		reserved = append(reserved, id)
+	}
+
+	return nil
+}
+
+// unreserveAggregates is the counterpart of reserveAggregates, called
+// unconditionally once the guarded action finishes, exactly like
+// unreserveResources is for the project-level quota.
+func (c *controller) unreserveAggregates(ctx context.Context, resources types.ResourceList, member AggregateMember) {
+	if member == nil {
+		return
+	}
+
+	aggregates, err := c.aggregateQuotas(ctx)
+	if err != nil {
+		log.G(ctx).Warningf("failed to list aggregate quotas, error: %v", err)
+		return
+	}
+
+	for _, agg := range aggregates {
+		selector, ok, err := c.AggregateSelector(ctx, agg.ID)
+		if err != nil || !ok || !selector.Matches(member) {
+			continue
+		}
+
+		refID := strconv.FormatInt(agg.ID, 10)
+		if err := c.unreserveResources(ctx, aggregateReference, refID, resources, nil); err != nil {
+			log.G(ctx).Warningf("unreserve aggregate quota %d failed, error: %v", agg.ID, err)
+		}
+	}
+}
+
+// propagateToAggregates applies the usage delta a member project's
+// Refresh just computed to every aggregate quota it belongs to, the way
+// UpdateQuotaStatus folds a namespace's status into its
+// ClusterResourceQuota. member is nil when the reference's driver doesn't
+// describe aggregate membership, in which case there's nothing to do.
+func (c *controller) propagateToAggregates(ctx context.Context, member AggregateMember, delta types.ResourceList) error {
+	if member == nil || len(delta) == 0 {
+		return nil
+	}
+
+	aggregates, err := c.aggregateQuotas(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, agg := range aggregates {
+		selector, ok, err := c.AggregateSelector(ctx, agg.ID)
+		if err != nil {
+			return err
+		}
+		if !ok || !selector.Matches(member) {
+			continue
+		}
+
+		if err := c.applyAggregateDelta(ctx, agg.ID, delta); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyAggregateDelta adds delta (which may have negative entries, from
+// types.Subtract) to the aggregate quota's Used. Aggregate quotas have no
+// registered driver, so Refresh never runs for them; this is where member
+// usage changes reach their Used, so it also reseeds the Redis used/hard
+// cache the Lua reservation path depends on and fires threshold events
+// for them, as Refresh does for an ordinary quota.
+//
+// Every member project's Refresh calls this on the same shared aggregate
+// row (via propagateToAggregates), so the read-modify-write of Used needs
+// the same row lock reserveResourcesDB and Refresh use for the
+// per-project row: GetByRefForUpdate. It does NOT open its own
+// orm.WithTransaction, though - its only caller is already inside
+// Refresh's own transaction, and starting a second one on the same ctx
+// would be a nested transaction. Join the caller's transaction instead by
+// just using ctx directly; Refresh's transaction commits or rolls back
+// this update along with everything else in the same Refresh.
+func (c *controller) applyAggregateDelta(ctx context.Context, id int64, delta types.ResourceList) error {
+	refID := strconv.FormatInt(id, 10)
+
+	agg, err := c.quotaMgr.GetByRefForUpdate(ctx, aggregateReference, refID)
+	if err != nil {
+		return err
+	}
+
+	used, err := agg.GetUsed()
+	if err != nil {
+		return err
+	}
+
+	hard, err := agg.GetHard()
+	if err != nil {
+		return err
+	}
+
+	newUsed := types.Add(used, delta)
+
+	agg.SetUsed(newUsed)
+	agg.UpdateTime = time.Now()
+
+	if err := c.quotaMgr.Update(ctx, agg); err != nil {
+		return err
+	}
+
+	if err := c.cacheUsedAndHard(aggregateReference, refID, newUsed, hard); err != nil {
+		log.G(ctx).Warningf("failed to seed used/hard cache for aggregate quota %d, error: %v", id, err)
+	}
+
+	c.checkThresholds(ctx, id, aggregateReference, refID, hard, newUsed)
+
+	return nil
+}
+
+// aggregateQuotas lists every quota configured as an aggregate. The query
+// is filtered server-side on Reference so that reserveAggregates and
+// unreserveAggregates, which run on every Request, and
+// propagateToAggregates, which runs on every Refresh, don't do a
+// full-table scan of the quota table on every push.
+func (c *controller) aggregateQuotas(ctx context.Context) ([]*quotaWithID, error) {
+	quotas, err := c.List(ctx, &q.Query{Keywords: map[string]interface{}{"Reference": aggregateReference}})
+	if err != nil {
+		return nil, err
+	}
+
+	aggregates := make([]*quotaWithID, 0, len(quotas))
+	for _, quota := range quotas {
+		aggregates = append(aggregates, &quotaWithID{ID: quota.ID})
+	}
+
+	return aggregates, nil
+}
+
+// quotaWithID is the minimal projection aggregateQuotas needs; keeping it
+// local avoids this file depending on quota.Quota's full shape.
+type quotaWithID struct {
+	ID int64
+}
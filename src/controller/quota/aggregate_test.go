@@ -0,0 +1,88 @@
+// Copyright Project Harbor Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReserveAggregateSetAllSucceed(t *testing.T) {
+	var reserved []int64
+
+	err := reserveAggregateSet([]int64{1, 2, 3},
+		func(id int64) error {
+			reserved = append(reserved, id)
+			return nil
+		},
+		func(id int64) {
+			t.Fatalf("unreserve called for %d, want no rollback", id)
+		},
+	)
+	if err != nil {
+		t.Fatalf("reserveAggregateSet: %v", err)
+	}
+	if len(reserved) != 3 {
+		t.Fatalf("reserved = %v, want all of [1 2 3]", reserved)
+	}
+}
+
+func TestReserveAggregateSetRollsBackOnFailure(t *testing.T) {
+	errExceeded := errors.New("would exceed quota 3")
+
+	var unreserved []int64
+
+	err := reserveAggregateSet([]int64{1, 2, 3},
+		func(id int64) error {
+			if id == 3 {
+				return errExceeded
+			}
+			return nil
+		},
+		func(id int64) {
+			unreserved = append(unreserved, id)
+		},
+	)
+	if !errors.Is(err, errExceeded) {
+		t.Fatalf("err = %v, want %v", err, errExceeded)
+	}
+
+	// the two quotas reserved before the failing one must be unreserved,
+	// in reverse order, and the failing one itself must not be.
+	want := []int64{2, 1}
+	if len(unreserved) != len(want) {
+		t.Fatalf("unreserved = %v, want %v", unreserved, want)
+	}
+	for i, id := range want {
+		if unreserved[i] != id {
+			t.Fatalf("unreserved = %v, want %v", unreserved, want)
+		}
+	}
+}
+
+func TestReserveAggregateSetEmpty(t *testing.T) {
+	err := reserveAggregateSet(nil,
+		func(id int64) error {
+			t.Fatalf("reserve called for %d, want no matching aggregates", id)
+			return nil
+		},
+		func(id int64) {
+			t.Fatalf("unreserve called for %d, want no matching aggregates", id)
+		},
+	)
+	if err != nil {
+		t.Fatalf("reserveAggregateSet: %v", err)
+	}
+}
@@ -41,6 +41,10 @@ var (
 var (
 	// Ctl is a global quota controller instance
 	Ctl = NewController()
+
+	// Replenish is the global Replenisher; callers wire it into Harbor's
+	// event bus and call Start once during startup.
+	Replenish = NewReplenisher(Ctl, 0)
 )
 
 // Controller defines the operations related with quotas
@@ -78,8 +82,54 @@ type Controller interface {
 	// in the finally it releases the resources which reserved at the beginning.
 	Request(ctx context.Context, reference, referenceID string, resources types.ResourceList, softQuotaEnabled bool, f func() error) error
 
+	// RequestWithSubject behaves like Request, but additionally matches
+	// subject against the scopes of every quota configured for the
+	// reference so that scoped quotas (e.g. limiting Helm charts or signed
+	// artifacts) are only reserved against when the incoming push actually
+	// falls inside their scope.
+	RequestWithSubject(ctx context.Context, reference, referenceID string, resources types.ResourceList, subject ScopeSubject, softQuotaEnabled bool, f func() error) error
+
+	// RequestWithAggregates behaves like RequestWithSubject, but
+	// additionally reserves resources against every aggregate quota whose
+	// selector matches member, failing the whole request atomically (and
+	// unreserving the project-level quota) if any aggregate would be
+	// exceeded. member is nil for references that don't belong to any
+	// aggregate (e.g. the reference isn't a project).
+	RequestWithAggregates(ctx context.Context, reference, referenceID string, resources types.ResourceList, subject ScopeSubject, member AggregateMember, softQuotaEnabled bool, f func() error) error
+
 	// Update update quota
 	Update(ctx context.Context, q *quota.Quota) error
+
+	// Scopes returns the scopes configured for the quota identified by id.
+	// A quota with no scopes covers the whole reference, exactly as quotas
+	// did before scopes existed.
+	Scopes(ctx context.Context, id int64) ([]Scope, error)
+
+	// SetScopes replaces the scopes configured for the quota identified by
+	// id. Passing no scopes clears them and makes the quota cover the
+	// whole reference again.
+	SetScopes(ctx context.Context, id int64, scopes ...Scope) error
+
+	// AggregateSelector returns the selector configured for the aggregate
+	// quota identified by id, and false if none has been set yet.
+	AggregateSelector(ctx context.Context, id int64) (AggregateSelector, bool, error)
+
+	// SetAggregateSelector sets the selector for the aggregate quota
+	// identified by id.
+	SetAggregateSelector(ctx context.Context, id int64, selector AggregateSelector) error
+
+	// MatchingMembers returns the subset of candidates that belong to the
+	// aggregate quota identified by id.
+	MatchingMembers(ctx context.Context, id int64, candidates []AggregateMember) ([]AggregateMember, error)
+
+	// Thresholds returns the percentage thresholds (e.g. 80, 90, 100)
+	// configured for the quota identified by id, sorted ascending. A quota
+	// with none configured gets a sane default.
+	Thresholds(ctx context.Context, id int64) ([]int, error)
+
+	// SetThresholds replaces the percentage thresholds configured for the
+	// quota identified by id. Passing none resets it to the default.
+	SetThresholds(ctx context.Context, id int64, thresholds ...int) error
 }
 
 // NewController creates an instance of the default quota controller
@@ -105,7 +155,30 @@ func (c *controller) Create(ctx context.Context, reference, referenceID string,
 }
 
 func (c *controller) Delete(ctx context.Context, id int64) error {
-	return c.quotaMgr.Delete(ctx, id)
+	quota, err := c.quotaMgr.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := c.quotaMgr.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	if err := deleteQuotaMetadata(ctx, id); err != nil {
+		log.G(ctx).Warningf("failed to delete metadata for quota %d, error: %v", id, err)
+	}
+
+	clearCachedMetadata(ctx,
+		scopesKey(id),
+		aggregateSelectorKey(id),
+		thresholdsKey(id),
+		lastFiredThresholdsKey(id),
+		reservedResourcesKey(quota.Reference, quota.ReferenceID),
+		usedCacheKey(quota.Reference, quota.ReferenceID),
+		hardCacheKey(quota.Reference, quota.ReferenceID),
+	)
+
+	return nil
 }
 
 func (c *controller) Get(ctx context.Context, id int64, options ...Option) (*quota.Quota, error) {
@@ -213,7 +286,68 @@ func (c *controller) setReservedResources(ctx context.Context, reference, refere
 	return nil
 }
 
-func (c *controller) reserveResources(ctx context.Context, reference, referenceID string, resources types.ResourceList) error {
+// quotaAppliesToReference reports whether the quota for reference/referenceID
+// should be reserved against for subject, based on its configured scopes.
+// A scoped quota with a nil subject fails open (not applied) rather than
+// guessing, since a caller still on Request/Refresh instead of
+// *WithSubject can't be matched against any scope; that case is logged
+// so a quota silently going unenforced because a call site wasn't
+// migrated doesn't go unnoticed.
+func (c *controller) quotaAppliesToReference(ctx context.Context, reference, referenceID string, subject ScopeSubject) (bool, error) {
+	q, err := c.quotaMgr.GetByRef(ctx, reference, referenceID)
+	if err != nil {
+		return false, err
+	}
+
+	scopes, err := c.Scopes(ctx, q.ID)
+	if err != nil {
+		return false, err
+	}
+
+	if len(scopes) > 0 && subject == nil {
+		log.G(ctx).Warningf("quota %d for %s %s has scopes configured but no subject was supplied (caller used Request/Refresh instead of *WithSubject); skipping enforcement for this call instead of guessing", q.ID, reference, referenceID)
+	}
+
+	return quotaAppliesToSubject(scopes, subject), nil
+}
+
+// reserveResources reserves resources for reference/referenceID. It tries
+// the atomic, lock-free Lua path first (see reserveResourcesAtomic) and
+// only falls back to the DB-transaction path, which doubles as seeding
+// the Redis-side used/hard cache the Lua path depends on, when that cache
+// hasn't been populated yet.
+func (c *controller) reserveResources(ctx context.Context, reference, referenceID string, resources types.ResourceList, subject ScopeSubject) error {
+	applies, err := c.quotaAppliesToReference(ctx, reference, referenceID, subject)
+	if err != nil {
+		return err
+	}
+	if !applies {
+		return nil
+	}
+
+	err = c.reserveResourcesAtomic(reference, referenceID, resources)
+	if err == nil {
+		return nil
+	}
+
+	if err == errHardCacheMiss {
+		log.G(ctx).Infof("hard/used cache miss for %s %s, falling back to the DB-backed reservation", reference, referenceID)
+		return c.reserveResourcesDB(ctx, reference, referenceID, resources)
+	}
+
+	if exceeded, ok := err.(*quotaExceededError); ok {
+		return errors.DeniedError(exceeded).WithMessage("Quota exceeded when processing the request of %v", exceeded)
+	}
+
+	return err
+}
+
+// reserveResourcesDB is the pre-Lua reservation path: it opens a DB
+// transaction, locks the quota row, and does a Redis GET/SET pair,
+// relying on the row lock as a mutex around the Redis value. It also
+// seeds the used/hard cache so the next reservation can use the atomic
+// Lua path instead.
+func (c *controller) reserveResourcesDB(ctx context.Context, reference, referenceID string, resources types.ResourceList) error {
 	reserve := func(ctx context.Context) error {
 		q, err := c.quotaMgr.GetByRefForUpdate(ctx, reference, referenceID)
 		if err != nil {
@@ -247,39 +381,54 @@ func (c *controller) reserveResources(ctx context.Context, reference, referenceI
 			return err
 		}
 
+		if err := c.cacheUsedAndHard(reference, referenceID, used, hardLimits); err != nil {
+			log.G(ctx).Warningf("failed to seed used/hard cache for %s %s, error: %v", reference, referenceID, err)
+		}
+
 		return nil
 	}
 
 	return orm.WithTransaction(reserve)(ctx)
 }
 
-func (c *controller) unreserveResources(ctx context.Context, reference, referenceID string, resources types.ResourceList) error {
-	unreserve := func(ctx context.Context) error {
-		if _, err := c.quotaMgr.GetByRefForUpdate(ctx, reference, referenceID); err != nil {
-			return err
-		}
+// quotaAppliesToSubject reports whether a push described by subject should
+// be counted against a quota configured with scopes. A quota with no
+// scopes always applies. A quota with scopes applies when subject matches
+// any one of them. subject is nil when the caller didn't supply one (e.g.
+// the legacy Request method), in which case scoped quotas are skipped
+// rather than guessed at.
+func quotaAppliesToSubject(scopes []Scope, subject ScopeSubject) bool {
+	if len(scopes) == 0 {
+		return true
+	}
 
-		reserved, err := c.getReservedResources(ctx, reference, referenceID)
-		if err != nil {
-			log.G(ctx).Errorf("failed to get reserved resources for %s %s, error: %v", reference, referenceID, err)
-			return err
-		}
+	if subject == nil {
+		return false
+	}
 
-		newReserved := types.Subtract(reserved, resources)
-		// ensure that new used is never negative
-		if negativeUsed := types.IsNegative(newReserved); len(negativeUsed) > 0 {
-			return fmt.Errorf("reserved resources is negative for resource(s): %s", quota.PrettyPrintResourceNames(negativeUsed))
+	for _, scope := range scopes {
+		if scope.Matches(subject) {
+			return true
 		}
+	}
 
-		if err := c.setReservedResources(ctx, reference, referenceID, newReserved); err != nil {
-			log.G(ctx).Errorf("failed to set reserved resources for %s %s, error: %v", reference, referenceID, err)
-			return err
-		}
+	return false
+}
 
+// unreserveResources releases a reservation previously made by
+// reserveResources. It runs as a single atomic Lua EVAL instead of a DB
+// transaction: unlike reserving, releasing never needs to check a hard
+// limit, so there's nothing here that depends on the used/hard cache.
+func (c *controller) unreserveResources(ctx context.Context, reference, referenceID string, resources types.ResourceList, subject ScopeSubject) error {
+	applies, err := c.quotaAppliesToReference(ctx, reference, referenceID, subject)
+	if err != nil {
+		return err
+	}
+	if !applies {
 		return nil
 	}
 
-	return orm.WithTransaction(unreserve)(ctx)
+	return c.unreserveResourcesAtomic(reference, referenceID, resources)
 }
 
 func (c *controller) Refresh(ctx context.Context, reference, referenceID string, options ...Option) error {
@@ -306,7 +455,12 @@ func (c *controller) Refresh(ctx context.Context, reference, referenceID string,
 			return err
 		}
 
-		newUsed, err := driver.CalculateUsage(ctx, referenceID)
+		scopes, err := c.Scopes(ctx, q.ID)
+		if err != nil {
+			return err
+		}
+
+		newUsed, err := usageForScopes(ctx, driver, referenceID, scopes, hardLimits)
 		if err != nil {
 			log.G(ctx).Errorf("failed to calculate quota usage for %s %s, error: %v", reference, referenceID, err)
 			return err
@@ -324,13 +478,39 @@ func (c *controller) Refresh(ctx context.Context, reference, referenceID string,
 		q.SetUsed(newUsed)
 		q.UpdateTime = time.Now()
 
-		return c.quotaMgr.Update(ctx, q)
+		if err := c.quotaMgr.Update(ctx, q); err != nil {
+			return err
+		}
+
+		if err := c.cacheUsedAndHard(reference, referenceID, newUsed, hardLimits); err != nil {
+			log.G(ctx).Warningf("failed to seed used/hard cache for %s %s, error: %v", reference, referenceID, err)
+		}
+
+		c.checkThresholds(ctx, q.ID, reference, referenceID, hardLimits, newUsed)
+
+		if ref, loadErr := driver.Load(ctx, referenceID); loadErr == nil {
+			if member, ok := ref.(AggregateMember); ok {
+				if err := c.propagateToAggregates(ctx, member, types.Subtract(newUsed, used)); err != nil {
+					log.G(ctx).Warningf("failed to propagate usage delta to aggregate quotas for %s %s, error: %v", reference, referenceID, err)
+				}
+			}
+		}
+
+		return nil
 	}
 
 	return orm.WithTransaction(refresh)(ctx)
 }
 
 func (c *controller) Request(ctx context.Context, reference, referenceID string, resources types.ResourceList, softQuotaEnabled bool, f func() error) error {
+	return c.RequestWithAggregates(ctx, reference, referenceID, resources, nil, nil, softQuotaEnabled, f)
+}
+
+func (c *controller) RequestWithSubject(ctx context.Context, reference, referenceID string, resources types.ResourceList, subject ScopeSubject, softQuotaEnabled bool, f func() error) error {
+	return c.RequestWithAggregates(ctx, reference, referenceID, resources, subject, nil, softQuotaEnabled, f)
+}
+
+func (c *controller) RequestWithAggregates(ctx context.Context, reference, referenceID string, resources types.ResourceList, subject ScopeSubject, member AggregateMember, softQuotaEnabled bool, f func() error) error {
 	if len(resources) == 0 {
 		return f()
 	}
@@ -341,46 +521,59 @@ func (c *controller) Request(ctx context.Context, reference, referenceID string,
 		if err != nil {
 			return err
 		}
-		currentUsed, err := driver.CalculateUsage(ctx, referenceID)
+
+		q, err := c.quotaMgr.GetByRefForUpdate(ctx, reference, referenceID)
 		if err != nil {
-			log.G(ctx).Errorf("failed to calculate quota usage for %s %s, error: %v", reference, referenceID, err)
 			return err
 		}
-		if negativeUsed := types.IsNegative(currentUsed); len(negativeUsed) > 0 {
-			return fmt.Errorf("quota usage is negative for resource(s): %s", quota.PrettyPrintResourceNames(negativeUsed))
-		}
 
-		q, err := c.quotaMgr.GetByRefForUpdate(ctx, reference, referenceID)
+		hardLimits, err := q.GetHard()
 		if err != nil {
 			return err
 		}
 
-		hardLimits, err := q.GetHard()
+		currentUsed, err := referenceUsage(ctx, driver, referenceID, hardLimits)
 		if err != nil {
+			log.G(ctx).Errorf("failed to calculate quota usage for %s %s, error: %v", reference, referenceID, err)
 			return err
 		}
+		if negativeUsed := types.IsNegative(currentUsed); len(negativeUsed) > 0 {
+			return fmt.Errorf("quota usage is negative for resource(s): %s", quota.PrettyPrintResourceNames(negativeUsed))
+		}
 
 		if err := quota.IsSafe(hardLimits, currentUsed, currentUsed, false); err != nil {
 			return err
 		}
 
+		// Don't fire threshold events against the predicted usage here:
+		// f() hasn't run yet and may still fail, and Refresh below fires
+		// checkThresholds against the real post-action usage for both the
+		// hard and soft paths anyway.
+
 	} else {
 		// hard quota
-		if err := c.reserveResources(ctx, reference, referenceID, resources); err != nil {
+		if err := c.reserveResources(ctx, reference, referenceID, resources, subject); err != nil {
 			return err
 		}
-	}
 
+		if err := c.reserveAggregates(ctx, resources, member); err != nil {
+			if unreserveErr := c.unreserveResources(ctx, reference, referenceID, resources, subject); unreserveErr != nil {
+				log.G(ctx).Warningf("unreserve resources %s for %s %s failed, error: %v", resources.String(), reference, referenceID, unreserveErr)
+			}
+			return err
+		}
+	}
 
 	defer func() {
 		if softQuotaEnabled {
 			// skip soft quota
 		} else {
-			if err := c.unreserveResources(ctx, reference, referenceID, resources); err != nil {
+			if err := c.unreserveResources(ctx, reference, referenceID, resources, subject); err != nil {
 				// ignore this error because reserved resources will be expired
 				// when no actions on the key of the reserved resources in redis during sometimes
 				log.G(ctx).Warningf("unreserve resources %s for %s %s failed, error: %v", resources.String(), reference, referenceID, err)
 			}
+			c.unreserveAggregates(ctx, resources, member)
 		}
 	}()
 
@@ -411,12 +604,66 @@ func (c *controller) Update(ctx context.Context, u *quota.Quota) error {
 		}
 
 		q.UpdateTime = time.Now()
-		return c.quotaMgr.Update(ctx, q)
+		if err := c.quotaMgr.Update(ctx, q); err != nil {
+			return err
+		}
+
+		hard, err := q.GetHard()
+		if err != nil {
+			return err
+		}
+
+		used, err := q.GetUsed()
+		if err != nil {
+			return err
+		}
+
+		// overwrite the Lua reservation path's cached used/hard so later
+		// reservations are checked against the new limit; a reservation
+		// that reads the cache before this point still sees the old one.
+		if err := c.cacheUsedAndHard(u.Reference, u.ReferenceID, used, hard); err != nil {
+			log.G(ctx).Warningf("failed to seed used/hard cache for %s %s, error: %v", u.Reference, u.ReferenceID, err)
+		}
+
+		return nil
 	}
 
 	return orm.WithTransaction(update)(ctx)
 }
 
+func (c *controller) Scopes(ctx context.Context, id int64) ([]Scope, error) {
+	var scopes []Scope
+	if _, err := loadCachedMetadata(ctx, id, metadataKindScope, scopesKey(id), &scopes); err != nil {
+		return nil, err
+	}
+
+	return scopes, nil
+}
+
+// scopesEnforceable gates SetScopes on at least one real call site having
+// been migrated to supply a ScopeSubject. quotaAppliesToReference fails a
+// scoped quota open (unenforced, just logged) whenever subject is nil,
+// and as of this series nothing calls RequestWithSubject /
+// RequestWithAggregates with a real subject - Request and
+// RequestWithSubject are the only callers, and Request always forwards
+// nil. Configuring a scope today would therefore silently disable
+// enforcement for that quota everywhere until a push path is migrated.
+// Flip this to true only once that migration has actually landed.
+const scopesEnforceable = false
+
+func (c *controller) SetScopes(ctx context.Context, id int64, scopes ...Scope) error {
+	if len(scopes) > 0 && !scopesEnforceable {
+		return errors.BadRequestError(fmt.Errorf("quota scopes are not enforceable in this deployment")).
+			WithMessage("quota scopes cannot be configured yet: no caller supplies a subject via RequestWithSubject, so a scoped quota would never be enforced")
+	}
+
+	if err := validateScopesDisjoint(scopes); err != nil {
+		return err
+	}
+
+	return storeCachedMetadata(ctx, id, metadataKindScope, scopesKey(id), scopes)
+}
+
 // Driver returns quota driver for the reference
 func Driver(ctx context.Context, reference string) (driver.Driver, error) {
 	d, ok := driver.Get(reference)
@@ -440,3 +687,7 @@ func Validate(ctx context.Context, reference string, hardLimits types.ResourceLi
 func reservedResourcesKey(reference, referenceID string) string {
 	return fmt.Sprintf("quota:%s:%s:reserved", reference, referenceID)
 }
+
+func scopesKey(id int64) string {
+	return fmt.Sprintf("quota:%d:scopes", id)
+}
@@ -0,0 +1,88 @@
+// Copyright Project Harbor Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/goharbor/harbor/src/lib/q"
+	"github.com/goharbor/harbor/src/pkg/artifact"
+	"github.com/goharbor/harbor/src/pkg/blob"
+	"github.com/goharbor/harbor/src/pkg/quota/evaluator"
+	"github.com/goharbor/harbor/src/pkg/quota/types"
+)
+
+func init() {
+	evaluator.Register(types.ResourceCount, artifactEvaluator{})
+	evaluator.Register(types.ResourceStorage, blobEvaluator{})
+}
+
+// artifactEvaluator computes types.ResourceCount usage for a project from
+// the artifact table, so referenceUsage no longer has to go through the
+// project driver's own CalculateUsage just to count artifacts.
+type artifactEvaluator struct{}
+
+func (artifactEvaluator) Usage(ctx context.Context, referenceID string) (types.ResourceList, error) {
+	projectID, err := strconv.ParseInt(referenceID, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := artifact.Mgr.Count(ctx, &q.Query{Keywords: map[string]interface{}{"ProjectID": projectID}})
+	if err != nil {
+		return nil, err
+	}
+
+	return types.ResourceList{types.ResourceCount: count}, nil
+}
+
+func (artifactEvaluator) MatchingResources(names []types.ResourceName) []types.ResourceName {
+	return matchingResources(names, types.ResourceCount)
+}
+
+// blobEvaluator computes types.ResourceStorage usage for a project from
+// the blob table.
+type blobEvaluator struct{}
+
+func (blobEvaluator) Usage(ctx context.Context, referenceID string) (types.ResourceList, error) {
+	projectID, err := strconv.ParseInt(referenceID, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := blob.Mgr.CalculateTotalSizeByProject(ctx, projectID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return types.ResourceList{types.ResourceStorage: size}, nil
+}
+
+func (blobEvaluator) MatchingResources(names []types.ResourceName) []types.ResourceName {
+	return matchingResources(names, types.ResourceStorage)
+}
+
+// matchingResources returns []types.ResourceName{kind} when kind is
+// present in names, nil otherwise.
+func matchingResources(names []types.ResourceName, kind types.ResourceName) []types.ResourceName {
+	for _, name := range names {
+		if name == kind {
+			return []types.ResourceName{kind}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+// Copyright Project Harbor Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/goharbor/harbor/src/lib/log"
+	"github.com/goharbor/harbor/src/lib/orm"
+	redislib "github.com/goharbor/harbor/src/lib/redis"
+	"github.com/gomodule/redigo/redis"
+)
+
+// Quota scopes (chunk0-1), aggregate selectors (chunk0-5) and thresholds
+// (chunk0-6) are configuration, not the ephemeral, recomputable-on-miss
+// state the reserved-resources/used/hard cache is. It's persisted here in
+// quota_ext_metadata (see the accompanying migration) with Redis only
+// used as a read-through cache, exactly like the used/hard cache in
+// reserve_lua.go: reseeded on every write, and reloaded from Postgres on
+// a cache miss instead of silently reverting to "unset".
+const (
+	metadataKindScope             = "scope"
+	metadataKindAggregateSelector = "aggregate_selector"
+	metadataKindThresholds        = "thresholds"
+)
+
+// getQuotaMetadata returns the raw JSON stored for (id, kind), and false
+// if nothing has been set.
+func getQuotaMetadata(ctx context.Context, id int64, kind string) (string, bool, error) {
+	o, err := orm.GetOrmer(ctx)
+	if err != nil {
+		return "", false, err
+	}
+
+	var data string
+	err = o.Raw(`SELECT data FROM quota_ext_metadata WHERE quota_id = ? AND kind = ?`, id, kind).QueryRow(&data)
+	if err == orm.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	return data, true, nil
+}
+
+// setQuotaMetadata upserts the raw JSON stored for (id, kind).
+func setQuotaMetadata(ctx context.Context, id int64, kind, data string) error {
+	o, err := orm.GetOrmer(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = o.Raw(`
+		INSERT INTO quota_ext_metadata (quota_id, kind, data, creation_time, update_time)
+		VALUES (?, ?, ?, now(), now())
+		ON CONFLICT (quota_id, kind) DO UPDATE SET data = excluded.data, update_time = now()
+	`, id, kind, data).Exec()
+
+	return err
+}
+
+// deleteQuotaMetadata removes every kind of metadata stored for id. It's
+// called from Controller.Delete so dropping a quota doesn't leak its
+// scope/selector/threshold configuration.
+func deleteQuotaMetadata(ctx context.Context, id int64) error {
+	o, err := orm.GetOrmer(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = o.Raw(`DELETE FROM quota_ext_metadata WHERE quota_id = ?`, id).Exec()
+	return err
+}
+
+// deleteQuotaMetadataKind removes a single kind of metadata stored for
+// id, e.g. resetting SetThresholds to the default when called with no
+// thresholds.
+func deleteQuotaMetadataKind(ctx context.Context, id int64, kind string) error {
+	o, err := orm.GetOrmer(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = o.Raw(`DELETE FROM quota_ext_metadata WHERE quota_id = ? AND kind = ?`, id, kind).Exec()
+	return err
+}
+
+// loadCachedMetadata unmarshals the JSON cached at redisKey into out and
+// reports whether it found anything. On a cache miss it falls back to
+// Postgres via getQuotaMetadata(id, kind) and reseeds redisKey so the
+// next read is a cache hit again.
+func loadCachedMetadata(ctx context.Context, id int64, kind, redisKey string, out interface{}) (bool, error) {
+	conn := redislib.DefaultPool().Get()
+	defer conn.Close()
+
+	if str, err := redis.String(conn.Do("GET", redisKey)); err == nil {
+		if jsonErr := json.Unmarshal([]byte(str), out); jsonErr == nil {
+			return true, nil
+		}
+	} else if err != redis.ErrNil {
+		log.G(ctx).Warningf("failed to read %s cache for quota %d, error: %v", kind, id, err)
+	}
+
+	data, ok, err := getQuotaMetadata(ctx, id, kind)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if err := json.Unmarshal([]byte(data), out); err != nil {
+		return false, err
+	}
+
+	if _, err := conn.Do("SET", redisKey, data); err != nil {
+		log.G(ctx).Warningf("failed to reseed %s cache for quota %d, error: %v", kind, id, err)
+	}
+
+	return true, nil
+}
+
+// storeCachedMetadata persists value as JSON for (id, kind) in Postgres,
+// the source of truth, then reseeds the Redis cache at redisKey so
+// readers don't have to round-trip to the DB on their very next read.
+func storeCachedMetadata(ctx context.Context, id int64, kind, redisKey string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	if err := setQuotaMetadata(ctx, id, kind, string(raw)); err != nil {
+		return err
+	}
+
+	conn := redislib.DefaultPool().Get()
+	defer conn.Close()
+
+	_, err = conn.Do("SET", redisKey, raw)
+	return err
+}
+
+// clearCachedMetadata deletes a quota's cached metadata keys from Redis.
+// Called alongside deleteQuotaMetadata from Controller.Delete.
+func clearCachedMetadata(ctx context.Context, keys ...string) {
+	conn := redislib.DefaultPool().Get()
+	defer conn.Close()
+
+	args := make([]interface{}, len(keys))
+	for i, k := range keys {
+		args[i] = k
+	}
+
+	if _, err := conn.Do("DEL", args...); err != nil {
+		log.G(ctx).Warningf("failed to clear cached metadata keys %v, error: %v", keys, err)
+	}
+}
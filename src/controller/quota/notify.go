@@ -0,0 +1,278 @@
+// Copyright Project Harbor Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/goharbor/harbor/src/lib/log"
+	redislib "github.com/goharbor/harbor/src/lib/redis"
+	"github.com/goharbor/harbor/src/pkg/quota/types"
+	"github.com/gomodule/redigo/redis"
+)
+
+// defaultThresholds is used by a quota that hasn't configured its own
+// threshold set, so soft quotas are useful for capacity planning out of
+// the box instead of silently passing through.
+var defaultThresholds = []int{80, 90, 100}
+
+// hysteresisMargin is how far usage has to drop below a fired threshold
+// before that threshold is armed to fire again, so a resource hovering
+// right at e.g. 90% doesn't fire a warning on every single Refresh.
+const hysteresisMargin = 5
+
+// EventType identifies a quota capacity event.
+type EventType string
+
+const (
+	// EventQuotaWarning fires when usage crosses a threshold below 100%.
+	EventQuotaWarning EventType = "QUOTA_WARNING"
+	// EventQuotaExceeded fires when usage crosses the 100% threshold.
+	EventQuotaExceeded EventType = "QUOTA_EXCEEDED"
+)
+
+// Event describes a quota resource crossing one of its configured
+// thresholds. It's meant to be handed to Harbor's notification/webhook
+// bus.
+type Event struct {
+	Type        EventType
+	Reference   string
+	ReferenceID string
+	Resource    types.ResourceName
+	Used        int64
+	Hard        int64
+	Percentage  int
+	Threshold   int
+}
+
+// EventSink receives quota Events. The notification/webhook bus
+// implements this and registers itself via SetEventSink; until one is
+// registered, events are dropped.
+type EventSink interface {
+	Notify(ctx context.Context, e Event)
+}
+
+var eventSink EventSink
+
+// SetEventSink registers the sink quota Events are delivered to.
+func SetEventSink(sink EventSink) {
+	eventSink = sink
+}
+
+func fireEvent(ctx context.Context, e Event) {
+	if eventSink == nil {
+		return
+	}
+
+	eventSink.Notify(ctx, e)
+}
+
+func thresholdsKey(id int64) string {
+	return fmt.Sprintf("quota:%d:thresholds", id)
+}
+
+// Thresholds returns the percentage thresholds (e.g. [80, 90, 100])
+// configured for the quota identified by id, sorted ascending. A quota
+// that hasn't configured any gets defaultThresholds.
+func (c *controller) Thresholds(ctx context.Context, id int64) ([]int, error) {
+	var thresholds []int
+	ok, err := loadCachedMetadata(ctx, id, metadataKindThresholds, thresholdsKey(id), &thresholds)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return defaultThresholds, nil
+	}
+
+	sort.Ints(thresholds)
+
+	return thresholds, nil
+}
+
+// SetThresholds replaces the percentage thresholds configured for the
+// quota identified by id. Passing none resets it to defaultThresholds.
+func (c *controller) SetThresholds(ctx context.Context, id int64, thresholds ...int) error {
+	if len(thresholds) == 0 {
+		if err := deleteQuotaMetadataKind(ctx, id, metadataKindThresholds); err != nil {
+			return err
+		}
+
+		clearCachedMetadata(ctx, thresholdsKey(id))
+		return nil
+	}
+
+	sort.Ints(thresholds)
+
+	return storeCachedMetadata(ctx, id, metadataKindThresholds, thresholdsKey(id), thresholds)
+}
+
+func lastFiredThresholdField(resource types.ResourceName) string {
+	return string(resource)
+}
+
+func lastFiredThresholdsKey(id int64) string {
+	return fmt.Sprintf("quota:%d:last-fired-threshold", id)
+}
+
+// lastFiredThreshold returns the highest threshold last fired for
+// (id, resource), or 0 if none has fired (or none has fired since it was
+// last armed by hysteresis). Persisting this in Redis, rather than
+// in-memory, is what keeps a restart from re-firing every threshold that
+// was already reported.
+func (c *controller) lastFiredThreshold(ctx context.Context, id int64, resource types.ResourceName) (int, error) {
+	conn := redislib.DefaultPool().Get()
+	defer conn.Close()
+
+	v, err := redis.Int(conn.Do("HGET", lastFiredThresholdsKey(id), lastFiredThresholdField(resource)))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+
+	return v, err
+}
+
+// setLastFiredThreshold, unlike scopes/selectors/thresholds, is kept in
+// Redis only: it's hysteresis bookkeeping re-derived from the next
+// Refresh/Request, not configuration, so losing it on a cache flush just
+// means a threshold that already fired may fire once more rather than
+// silently reverting a setting. It has no expiration, so a fired
+// threshold stays recorded until hysteresis rearms it; Delete removes the
+// key together with the quota's other cached keys.
+func (c *controller) setLastFiredThreshold(ctx context.Context, id int64, resource types.ResourceName, threshold int) error {
+	conn := redislib.DefaultPool().Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HSET", lastFiredThresholdsKey(id), lastFiredThresholdField(resource), threshold)
+	return err
+}
+
+// checkThresholds compares newUsed against hardLimits for the quota
+// identified by id and fires a QUOTA_WARNING/QUOTA_EXCEEDED Event for
+// every resource that just crossed a configured threshold upward. It
+// applies hysteresis: a threshold that already fired only arms again once
+// usage drops below threshold-hysteresisMargin percent, so a resource
+// oscillating around one threshold doesn't spam the webhook bus.
+func (c *controller) checkThresholds(ctx context.Context, id int64, reference, referenceID string, hardLimits, newUsed types.ResourceList) {
+	thresholds, err := c.Thresholds(ctx, id)
+	if err != nil {
+		log.G(ctx).Warningf("failed to load quota thresholds for %s %s, error: %v", reference, referenceID, err)
+		return
+	}
+
+	for resource, hard := range hardLimits {
+		if hard < 0 {
+			// unlimited, nothing to warn about; a hard limit of 0 is a
+			// legitimate zero-capacity limit and must still be checked,
+			// matching the convention reserveScript uses (reserve_lua.go).
+			continue
+		}
+
+		used := newUsed[resource]
+		pct := percentageOf(used, hard)
+
+		lastFired, err := c.lastFiredThreshold(ctx, id, resource)
+		if err != nil {
+			log.G(ctx).Warningf("failed to load last fired threshold for %s %s %s, error: %v", reference, referenceID, resource, err)
+			continue
+		}
+
+		newLastFired, changed := thresholdTransition(pct, thresholds, lastFired)
+		if !changed {
+			continue
+		}
+
+		if newLastFired > lastFired {
+			eventType := EventQuotaWarning
+			if newLastFired >= 100 {
+				eventType = EventQuotaExceeded
+			}
+
+			fireEvent(ctx, Event{
+				Type:        eventType,
+				Reference:   reference,
+				ReferenceID: referenceID,
+				Resource:    resource,
+				Used:        used,
+				Hard:        hard,
+				Percentage:  pct,
+				Threshold:   newLastFired,
+			})
+		}
+
+		if err := c.setLastFiredThreshold(ctx, id, resource, newLastFired); err != nil {
+			log.G(ctx).Warningf("failed to persist last fired threshold for %s %s %s, error: %v", reference, referenceID, resource, err)
+		}
+	}
+}
+
+// percentageOf returns used/hard as a percentage. hard is assumed >= 0
+// (callers skip unlimited, hard < 0, resources before calling); hard == 0
+// is a legitimate zero-capacity limit under which every reservation is
+// denied, so any usage at all is reported as 100% rather than dividing by
+// zero.
+func percentageOf(used, hard int64) int {
+	if hard == 0 {
+		if used <= 0 {
+			return 0
+		}
+		return 100
+	}
+
+	return int(used * 100 / hard)
+}
+
+// thresholdTransition decides, given the current usage percentage,
+// the quota's configured thresholds, and the highest threshold last
+// fired, whether a threshold event should fire now and what the new
+// "last fired" value is. changed is false when neither a new threshold
+// was crossed upward nor hysteresis armed a previous one again, meaning
+// the caller has nothing to persist.
+func thresholdTransition(pct int, thresholds []int, lastFired int) (newLastFired int, changed bool) {
+	crossed := 0
+	for _, threshold := range thresholds {
+		if pct >= threshold {
+			crossed = threshold
+		}
+	}
+
+	if crossed > lastFired {
+		return crossed, true
+	}
+
+	// No new threshold was crossed upward this time. Recompute how far
+	// hysteresis has rearmed instead of collapsing lastFired straight to
+	// 0 the moment pct dips below just the highest threshold: every
+	// threshold at or below lastFired is implicitly still "fired" until
+	// pct drops below *that threshold's own* margin, since it must have
+	// been crossed on the way up to lastFired. Resetting to 0 unconditionally
+	// forgets that, so a drop that skips over an intermediate band (e.g.
+	// 100 -> 83, clearing 90 and 100 but still above 80) would make the
+	// next no-op Refresh at the same percentage re-fire 80 as if it were
+	// newly crossed.
+	armed := 0
+	for _, threshold := range thresholds {
+		if threshold <= lastFired && pct >= threshold-hysteresisMargin {
+			armed = threshold
+		}
+	}
+
+	if armed != lastFired {
+		return armed, true
+	}
+
+	return lastFired, false
+}
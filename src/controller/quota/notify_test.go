@@ -0,0 +1,97 @@
+// Copyright Project Harbor Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import "testing"
+
+func TestPercentageOf(t *testing.T) {
+	cases := []struct {
+		name string
+		used int64
+		hard int64
+		want int
+	}{
+		{"half", 50, 100, 50},
+		{"over", 150, 100, 150},
+		{"zero hard, no usage", 0, 0, 0},
+		{"zero hard, some usage", 1, 0, 100},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := percentageOf(c.used, c.hard); got != c.want {
+				t.Errorf("percentageOf(%d, %d) = %d, want %d", c.used, c.hard, got, c.want)
+			}
+		})
+	}
+}
+
+func TestThresholdTransition(t *testing.T) {
+	thresholds := []int{80, 90, 100}
+
+	cases := []struct {
+		name          string
+		pct           int
+		lastFired     int
+		wantLastFired int
+		wantChanged   bool
+	}{
+		{"below every threshold", 50, 0, 0, false},
+		{"crosses the first threshold", 85, 0, 80, true},
+		{"crosses a higher threshold", 95, 80, 90, true},
+		{"crosses into exceeded", 100, 90, 100, true},
+		{"stays at the same threshold", 85, 80, 80, false},
+		{"drops but stays within the hysteresis margin", 76, 80, 80, false},
+		{"drops below the hysteresis margin, arms again", 74, 80, 0, true},
+		{"re-crosses after arming", 85, 0, 80, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gotLastFired, gotChanged := thresholdTransition(c.pct, thresholds, c.lastFired)
+			if gotLastFired != c.wantLastFired || gotChanged != c.wantChanged {
+				t.Errorf("thresholdTransition(%d, %v, %d) = (%d, %v), want (%d, %v)",
+					c.pct, thresholds, c.lastFired, gotLastFired, gotChanged, c.wantLastFired, c.wantChanged)
+			}
+		})
+	}
+}
+
+// TestThresholdTransitionDropSkipsIntermediateBand covers a drop that
+// clears more than one threshold at once (100 -> 83 clears 90 and 100 but
+// stays above 80), then a no-op Refresh at that same percentage - e.g.
+// the periodic resync from the replenishment subsystem, which runs on a
+// fixed interval regardless of whether usage actually changed. Neither
+// step should re-fire the 80% threshold: it never stopped being crossed.
+func TestThresholdTransitionDropSkipsIntermediateBand(t *testing.T) {
+	thresholds := []int{80, 90, 100}
+
+	lastFired, changed := thresholdTransition(100, thresholds, 0)
+	if lastFired != 100 || !changed {
+		t.Fatalf("climb to 100: thresholdTransition = (%d, %v), want (100, true)", lastFired, changed)
+	}
+
+	lastFired, changed = thresholdTransition(83, thresholds, lastFired)
+	if lastFired != 80 || !changed {
+		t.Fatalf("drop to 83: thresholdTransition = (%d, %v), want (80, true) - rearming 90 and 100 shouldn't forget 80 is still crossed", lastFired, changed)
+	}
+
+	// A later Refresh at the same 83%, with nothing having actually
+	// changed, must not treat 80 as newly crossed again.
+	lastFired, changed = thresholdTransition(83, thresholds, lastFired)
+	if lastFired != 80 || changed {
+		t.Fatalf("no-op refresh at 83: thresholdTransition = (%d, %v), want (80, false) - got a spurious re-fire of the 80%% threshold", lastFired, changed)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright Project Harbor Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/goharbor/harbor/src/lib/log"
+	"github.com/goharbor/harbor/src/lib/q"
+)
+
+// defaultResyncInterval is how often the Replenisher walks every quota and
+// refreshes it, to close any drift window an event was missed for.
+var defaultResyncInterval = 5 * time.Minute
+
+// reference identifies the object a quota is attached to.
+type reference struct {
+	reference   string
+	referenceID string
+}
+
+// Replenisher keeps quota usage in sync with reality without relying on
+// every mutation going through Controller.Request. It reacts to Harbor
+// events (artifact/blob deleted, tag retention executed, GC finished,
+// replication completed, ...) by enqueuing an async Refresh for the
+// affected reference, and additionally walks every quota on a fixed
+// interval as a backstop for events it never saw. This mirrors the
+// ResourceQuotaController.replenishQuota / syncResourceQuota pattern.
+type Replenisher struct {
+	ctl            Controller
+	resyncInterval time.Duration
+
+	mu      sync.Mutex
+	pending map[reference]bool
+	notify  chan struct{}
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewReplenisher creates a Replenisher that refreshes quotas against ctl.
+// A resyncInterval of zero uses defaultResyncInterval.
+func NewReplenisher(ctl Controller, resyncInterval time.Duration) *Replenisher {
+	if resyncInterval <= 0 {
+		resyncInterval = defaultResyncInterval
+	}
+
+	return &Replenisher{
+		ctl:            ctl,
+		resyncInterval: resyncInterval,
+		pending:        make(map[reference]bool),
+		notify:         make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+	}
+}
+
+// Enqueue schedules an async Refresh of ref/refID. Events fired in bulk
+// for the same reference (e.g. 10k blob deletes during one GC run)
+// coalesce into a single pending Refresh.
+func (r *Replenisher) Enqueue(ref, refID string) {
+	key := reference{reference: ref, referenceID: refID}
+
+	r.mu.Lock()
+	r.pending[key] = true
+	r.mu.Unlock()
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+		// a wake-up is already pending, this event will be picked up by it
+	}
+}
+
+// OnArtifactDeleted enqueues a Refresh for the project an artifact used to
+// belong to.
+func (r *Replenisher) OnArtifactDeleted(projectID string) {
+	r.Enqueue("project", projectID)
+}
+
+// OnBlobDeleted enqueues a Refresh for the project a blob used to belong
+// to.
+func (r *Replenisher) OnBlobDeleted(projectID string) {
+	r.Enqueue("project", projectID)
+}
+
+// OnRetentionExecuted enqueues a Refresh for the project a tag retention
+// run just pruned tags from.
+func (r *Replenisher) OnRetentionExecuted(projectID string) {
+	r.Enqueue("project", projectID)
+}
+
+// OnGCFinished enqueues a Refresh for every project, since GC reclaims
+// blobs shared across projects and there's no cheap way to know which
+// projects it actually freed space in.
+func (r *Replenisher) OnGCFinished(ctx context.Context) {
+	r.enqueueAll(ctx)
+}
+
+// OnReplicationCompleted enqueues a Refresh for the project a replication
+// run just copied artifacts into.
+func (r *Replenisher) OnReplicationCompleted(projectID string) {
+	r.Enqueue("project", projectID)
+}
+
+// Start runs the coalescing drain loop and the periodic full resync until
+// ctx is done or Stop is called.
+func (r *Replenisher) Start(ctx context.Context) {
+	go r.drainLoop(ctx)
+	go r.resyncLoop(ctx)
+}
+
+// Stop terminates the Replenisher's background loops.
+func (r *Replenisher) Stop() {
+	r.once.Do(func() { close(r.stop) })
+}
+
+func (r *Replenisher) drainLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.stop:
+			return
+		case <-r.notify:
+			r.drain(ctx)
+		}
+	}
+}
+
+func (r *Replenisher) drain(ctx context.Context) {
+	r.mu.Lock()
+	refs := r.pending
+	r.pending = make(map[reference]bool)
+	r.mu.Unlock()
+
+	for ref := range refs {
+		if err := r.ctl.Refresh(ctx, ref.reference, ref.referenceID); err != nil {
+			log.G(ctx).Errorf("failed to replenish quota for %s %s, error: %v", ref.reference, ref.referenceID, err)
+		}
+	}
+}
+
+func (r *Replenisher) resyncLoop(ctx context.Context) {
+	ticker := time.NewTicker(r.resyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.enqueueAll(ctx)
+		}
+	}
+}
+
+// enqueueAll walks every quota and enqueues a Refresh for it, matching
+// syncResourceQuota: a periodic full resync that closes any drift window
+// left by an event the Replenisher never received. Aggregate quotas are
+// skipped: they have no registered driver, so Refresh(ctx, "aggregate",
+// id) always fails in Driver(), and their Used is instead kept current
+// by applyAggregateDelta whenever a member project refreshes.
+func (r *Replenisher) enqueueAll(ctx context.Context) {
+	quotas, err := r.ctl.List(ctx, &q.Query{})
+	if err != nil {
+		log.G(ctx).Errorf("failed to list quotas for resync, error: %v", err)
+		return
+	}
+
+	for _, quota := range quotas {
+		if quota.Reference == aggregateReference {
+			continue
+		}
+		r.Enqueue(quota.Reference, quota.ReferenceID)
+	}
+}
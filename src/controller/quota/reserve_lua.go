@@ -0,0 +1,200 @@
+// Copyright Project Harbor Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	redislib "github.com/goharbor/harbor/src/lib/redis"
+	"github.com/goharbor/harbor/src/pkg/quota/types"
+	"github.com/gomodule/redigo/redis"
+)
+
+// errHardCacheMiss is returned by the Lua reservation path when Redis
+// doesn't have a cached hard/used value for the reference yet (e.g. right
+// after a restart, or before the first Refresh seeded it). Callers fall
+// back to the DB-backed reservation path, which also seeds the cache.
+var errHardCacheMiss = errors.New("quota: hard/used cache miss")
+
+// quotaExceededError reports that a reservation was rejected because it
+// would push one or more resources past their hard limit.
+type quotaExceededError struct {
+	resources string
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded for resource(s): %s", e.resources)
+}
+
+// reserveScript atomically adds delta to the reserved resources cached at
+// KEYS[1] and checks the result against the used/hard values cached at
+// KEYS[2] and KEYS[3], replacing the previous approach of using a
+// Postgres row lock (GetByRefForUpdate) purely as a mutex around a Redis
+// GET/SET pair. A hard limit of -1 for a resource means unlimited,
+// matching quota.IsSafe.
+//
+// Reply: {1, "<new reserved JSON>"} on success, {0, "<exceeded JSON>"} when
+// the reservation would exceed the hard limit, or {-1} when the used/hard
+// cache at KEYS[2]/KEYS[3] hasn't been seeded yet.
+var reserveScript = redis.NewScript(3, `
+local reservedKey = KEYS[1]
+local usedKey = KEYS[2]
+local hardKey = KEYS[3]
+
+local usedStr = redis.call('GET', usedKey)
+local hardStr = redis.call('GET', hardKey)
+if not usedStr or not hardStr then
+	return {-1}
+end
+
+local used = cjson.decode(usedStr)
+local hard = cjson.decode(hardStr)
+local delta = cjson.decode(ARGV[1])
+local ttl = tonumber(ARGV[2])
+
+local reserved = {}
+local reservedStr = redis.call('GET', reservedKey)
+if reservedStr then
+	reserved = cjson.decode(reservedStr)
+end
+
+for name, amount in pairs(delta) do
+	reserved[name] = (reserved[name] or 0) + amount
+end
+
+local exceeded = {}
+for name, limit in pairs(hard) do
+	if limit >= 0 then
+		local total = (used[name] or 0) + (reserved[name] or 0)
+		if total > limit then
+			table.insert(exceeded, name)
+		end
+	end
+end
+
+if #exceeded > 0 then
+	return {0, cjson.encode(exceeded)}
+end
+
+local reservedStr2 = cjson.encode(reserved)
+redis.call('SET', reservedKey, reservedStr2, 'EX', ttl)
+return {1, reservedStr2}
+`)
+
+// unreserveScript atomically subtracts delta from the reserved resources
+// cached at KEYS[1], floored at zero per resource so a late/duplicate
+// unreserve can never push it negative. KEEPTTL preserves whatever
+// expiry reserveScript's EX set, since otherwise a plain SET would strip
+// it and leave the key resident in Redis forever - unreserveResources is
+// called unconditionally on essentially every push, so without KEEPTTL
+// the reserved-resources key would never actually expire as documented
+// by defaultReservedExpiration.
+//
+// Reply: the new reserved resources, JSON-encoded.
+var unreserveScript = redis.NewScript(1, `
+local reservedKey = KEYS[1]
+local delta = cjson.decode(ARGV[1])
+
+local reserved = {}
+local reservedStr = redis.call('GET', reservedKey)
+if reservedStr then
+	reserved = cjson.decode(reservedStr)
+end
+
+for name, amount in pairs(delta) do
+	local v = (reserved[name] or 0) - amount
+	if v < 0 then
+		v = 0
+	end
+	reserved[name] = v
+end
+
+local reservedStr2 = cjson.encode(reserved)
+redis.call('SET', reservedKey, reservedStr2, 'KEEPTTL')
+return reservedStr2
+`)
+
+// unreserveResourcesAtomic releases a previous reservation without going
+// through a DB transaction.
+func (c *controller) unreserveResourcesAtomic(reference, referenceID string, resources types.ResourceList) error {
+	conn := redislib.DefaultPool().Get()
+	defer conn.Close()
+
+	_, err := redis.String(unreserveScript.Do(conn, reservedResourcesKey(reference, referenceID), resources.String()))
+	return err
+}
+
+func usedCacheKey(reference, referenceID string) string {
+	return fmt.Sprintf("quota:%s:%s:used", reference, referenceID)
+}
+
+func hardCacheKey(reference, referenceID string) string {
+	return fmt.Sprintf("quota:%s:%s:hard", reference, referenceID)
+}
+
+// cacheUsedAndHard seeds (or invalidates, by overwriting) the Redis-side
+// used/hard cache that reserveResources' Lua path reads. It's called on
+// quota update, quota refresh, aggregate delta updates and the DB-backed
+// reservation path. Quota create does not call it, so the first
+// reservation against a new quota goes through reserveResourcesDB.
+func (c *controller) cacheUsedAndHard(reference, referenceID string, used, hard types.ResourceList) error {
+	conn := redislib.DefaultPool().Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	conn.Send("SET", usedCacheKey(reference, referenceID), used.String())
+	conn.Send("SET", hardCacheKey(reference, referenceID), hard.String())
+
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// reserveResourcesAtomic tries to reserve resources via reserveScript. It
+// returns errHardCacheMiss when the used/hard cache isn't populated yet,
+// so the caller can fall back to the DB-backed reserveResourcesDB.
+func (c *controller) reserveResourcesAtomic(reference, referenceID string, resources types.ResourceList) error {
+	conn := redislib.DefaultPool().Get()
+	defer conn.Close()
+
+	reply, err := redis.Values(reserveScript.Do(conn,
+		reservedResourcesKey(reference, referenceID),
+		usedCacheKey(reference, referenceID),
+		hardCacheKey(reference, referenceID),
+		resources.String(),
+		int64(c.reservedExpiration/time.Second),
+	))
+	if err != nil {
+		return err
+	}
+
+	status, err := redis.Int(reply[0], nil)
+	if err != nil {
+		return err
+	}
+
+	switch status {
+	case -1:
+		return errHardCacheMiss
+	case 0:
+		exceeded, _ := redis.String(reply[1], nil)
+		return &quotaExceededError{resources: exceeded}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright Project Harbor Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+func newTestRedisConn(t *testing.T) redis.Conn {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+
+	conn, err := redis.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatalf("failed to dial miniredis: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestReserveScriptRoundTrip(t *testing.T) {
+	conn := newTestRedisConn(t)
+
+	const reservedKey, usedKey, hardKey = "reserved", "used", "hard"
+
+	if _, err := conn.Do("SET", usedKey, `{"storage":0}`); err != nil {
+		t.Fatalf("seed used: %v", err)
+	}
+	if _, err := conn.Do("SET", hardKey, `{"storage":100}`); err != nil {
+		t.Fatalf("seed hard: %v", err)
+	}
+
+	reply, err := redis.Values(reserveScript.Do(conn, reservedKey, usedKey, hardKey, `{"storage":60}`, int64(3600)))
+	if err != nil {
+		t.Fatalf("reserve 60: %v", err)
+	}
+	status, _ := redis.Int(reply[0], nil)
+	if status != 1 {
+		t.Fatalf("reserve 60: status = %d, want 1 (admitted)", status)
+	}
+
+	reply, err = redis.Values(reserveScript.Do(conn, reservedKey, usedKey, hardKey, `{"storage":60}`, int64(3600)))
+	if err != nil {
+		t.Fatalf("reserve another 60: %v", err)
+	}
+	status, _ = redis.Int(reply[0], nil)
+	if status != 0 {
+		t.Fatalf("reserve another 60: status = %d, want 0 (exceeded)", status)
+	}
+
+	unreserved, err := redis.String(unreserveScript.Do(conn, reservedKey, `{"storage":60}`))
+	if err != nil {
+		t.Fatalf("unreserve 60: %v", err)
+	}
+	if unreserved != `{"storage":0}` {
+		t.Fatalf("unreserve 60: reserved = %s, want {\"storage\":0}", unreserved)
+	}
+
+	// a second unreserve for more than what's left floors at zero instead
+	// of going negative.
+	unreserved, err = redis.String(unreserveScript.Do(conn, reservedKey, `{"storage":60}`))
+	if err != nil {
+		t.Fatalf("unreserve past zero: %v", err)
+	}
+	if unreserved != `{"storage":0}` {
+		t.Fatalf("unreserve past zero: reserved = %s, want {\"storage\":0}", unreserved)
+	}
+}
+
+func TestUnreserveScriptPreservesTTL(t *testing.T) {
+	conn := newTestRedisConn(t)
+
+	const reservedKey, usedKey, hardKey = "reserved", "used", "hard"
+
+	if _, err := conn.Do("SET", usedKey, `{"storage":0}`); err != nil {
+		t.Fatalf("seed used: %v", err)
+	}
+	if _, err := conn.Do("SET", hardKey, `{"storage":100}`); err != nil {
+		t.Fatalf("seed hard: %v", err)
+	}
+
+	if _, err := redis.Values(reserveScript.Do(conn, reservedKey, usedKey, hardKey, `{"storage":60}`, int64(3600))); err != nil {
+		t.Fatalf("reserve 60: %v", err)
+	}
+
+	if _, err := unreserveScript.Do(conn, reservedKey, `{"storage":10}`); err != nil {
+		t.Fatalf("unreserve 10: %v", err)
+	}
+
+	ttl, err := redis.Int64(conn.Do("TTL", reservedKey))
+	if err != nil {
+		t.Fatalf("TTL: %v", err)
+	}
+	if ttl <= 0 {
+		t.Fatalf("TTL(%s) = %d after unreserve, want a positive TTL (reserveScript's EX should survive, not be stripped)", reservedKey, ttl)
+	}
+}
+
+func TestReserveScriptCacheMiss(t *testing.T) {
+	conn := newTestRedisConn(t)
+
+	reply, err := redis.Values(reserveScript.Do(conn, "reserved", "used", "hard", `{"storage":1}`, int64(3600)))
+	if err != nil {
+		t.Fatalf("reserve with no cached used/hard: %v", err)
+	}
+
+	status, _ := redis.Int(reply[0], nil)
+	if status != -1 {
+		t.Fatalf("reserve with no cached used/hard: status = %d, want -1 (cache miss)", status)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright Project Harbor Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/goharbor/harbor/src/lib/errors"
+	"github.com/goharbor/harbor/src/pkg/quota/driver"
+	"github.com/goharbor/harbor/src/pkg/quota/evaluator"
+	"github.com/goharbor/harbor/src/pkg/quota/types"
+)
+
+// hardLimitNames returns the resource names tracked by hardLimits, in the
+// form the evaluator registry expects.
+func hardLimitNames(hardLimits types.ResourceList) []types.ResourceName {
+	names := make([]types.ResourceName, 0, len(hardLimits))
+	for name := range hardLimits {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// Scope narrows a quota so that it tracks usage, and is enforced against,
+// only a subset of a reference's resources instead of the whole reference.
+// A quota with no scopes behaves exactly as before and covers everything
+// under the reference. Fields set within one Scope are ANDed together;
+// zero-value fields are ignored. Multiple Scopes on the same quota are
+// ORed: a push matching any one of them is admitted, which is why
+// validateScopesDisjoint requires the scopes on a quota not to overlap -
+// an overlapping pair would otherwise double-count a push that matches
+// both.
+type Scope struct {
+	// MediaType restricts the scope to artifacts of the given OCI media
+	// type, e.g. "application/vnd.oci.image.manifest.v1+json".
+	MediaType string `json:"media_type,omitempty"`
+	// RepositoryPrefix restricts the scope to repositories whose name
+	// starts with the given prefix, e.g. "library/".
+	RepositoryPrefix string `json:"repository_prefix,omitempty"`
+	// Signed, when non-nil, restricts the scope to signed (true) or
+	// unsigned (false) artifacts.
+	Signed *bool `json:"signed,omitempty"`
+}
+
+// IsZero reports whether the scope matches every resource under the
+// reference, i.e. it behaves like no scope at all.
+func (s Scope) IsZero() bool {
+	return s.MediaType == "" && s.RepositoryPrefix == "" && s.Signed == nil
+}
+
+// Matches reports whether subject satisfies every field set on the scope.
+func (s Scope) Matches(subject ScopeSubject) bool {
+	if s.MediaType != "" && subject.MediaType() != s.MediaType {
+		return false
+	}
+	if s.RepositoryPrefix != "" && !strings.HasPrefix(subject.RepositoryFullName(), s.RepositoryPrefix) {
+		return false
+	}
+	if s.Signed != nil && subject.IsSigned() != *s.Signed {
+		return false
+	}
+
+	return true
+}
+
+// ScopeSubject is the minimal view of an incoming push that reserveResources
+// needs in order to decide which scoped quotas the push counts against.
+type ScopeSubject interface {
+	// MediaType returns the OCI media type of the artifact being pushed.
+	MediaType() string
+	// RepositoryFullName returns the "project/repository" the artifact is
+	// pushed to.
+	RepositoryFullName() string
+	// IsSigned reports whether the artifact being pushed is signed.
+	IsSigned() bool
+}
+
+// ScopedDriver is an optional interface a driver.Driver can implement to
+// support calculating usage restricted to a Scope. Drivers that only know
+// how to calculate reference-wide usage don't need to implement it;
+// Refresh uses reference-wide usage (referenceUsage) for quotas that have
+// no scopes configured.
+//
+// No driver in this codebase implements ScopedDriver yet. Until one does,
+// configuring scopes on a quota only narrows admission - which scoped
+// quota an incoming push counts against, decided at push time by
+// quotaAppliesToSubject - and does not change what the quota's Used
+// tracks: usageForScopes falls back to unscoped, reference-wide usage
+// rather than guessing at a per-scope split it has no way to compute.
+type ScopedDriver interface {
+	driver.Driver
+
+	// CalculateUsageByScope returns the usage of referenceID restricted to
+	// the resources selected by scope.
+	CalculateUsageByScope(ctx context.Context, referenceID string, scope Scope) (types.ResourceList, error)
+}
+
+// usageForScope returns the usage of referenceID restricted to scope,
+// using the driver's scoped evaluator. Only call this once d has already
+// been confirmed to implement ScopedDriver; there is no meaningful
+// per-scope usage without one.
+func usageForScope(ctx context.Context, scoped ScopedDriver, referenceID string, scope Scope) (types.ResourceList, error) {
+	return scoped.CalculateUsageByScope(ctx, referenceID, scope)
+}
+
+// scopesOverlap reports whether some subject could match both a and b,
+// i.e. whether summing their usage would double-count that subject.
+// Two scopes overlap unless they disagree on a field both of them set;
+// an unset field is a wildcard that overlaps anything, and
+// RepositoryPrefix overlaps when one prefix extends the other.
+func scopesOverlap(a, b Scope) bool {
+	if a.MediaType != "" && b.MediaType != "" && a.MediaType != b.MediaType {
+		return false
+	}
+
+	if a.Signed != nil && b.Signed != nil && *a.Signed != *b.Signed {
+		return false
+	}
+
+	if a.RepositoryPrefix != "" && b.RepositoryPrefix != "" &&
+		!strings.HasPrefix(a.RepositoryPrefix, b.RepositoryPrefix) &&
+		!strings.HasPrefix(b.RepositoryPrefix, a.RepositoryPrefix) {
+		return false
+	}
+
+	return true
+}
+
+// validateScopesDisjoint rejects a scope set where two scopes could match
+// the same subject. usageForScopes sums usage across scopes to match the
+// OR admission semantics in quotaAppliesToSubject; summing overlapping
+// scopes would double-count a subject matching more than one of them, so
+// disjointness is enforced here instead of left as a caller concern.
+func validateScopesDisjoint(scopes []Scope) error {
+	for i := range scopes {
+		for j := i + 1; j < len(scopes); j++ {
+			if scopesOverlap(scopes[i], scopes[j]) {
+				return errors.BadRequestError(fmt.Errorf("scopes %d and %d overlap", i, j)).
+					WithMessage("quota scopes must be disjoint, but scope %d and scope %d can both match the same subject", i, j)
+			}
+		}
+	}
+
+	return nil
+}
+
+// usageForScopes returns the reference-wide usage when the quota has no
+// scopes, or the sum of the usage matched by each configured scope
+// otherwise. Scopes are validated to be disjoint when they're set (see
+// validateScopesDisjoint), so summing them here can't double-count a
+// subject the way an OR-matched, overlapping scope set would.
+//
+// Summing per-scope usage is only correct when the driver can actually
+// compute it, i.e. implements ScopedDriver. No driver in this codebase
+// does yet, so until one exists, scopes only narrow admission (which
+// quota a push counts against, via quotaAppliesToSubject) and don't
+// change what Used tracks: falling back to referenceUsage once per scope
+// would sum the same unfiltered usage N times for N scopes, inflating
+// Used by Nx instead of reporting it correctly scoped.
+func usageForScopes(ctx context.Context, d driver.Driver, referenceID string, scopes []Scope, hardLimits types.ResourceList) (types.ResourceList, error) {
+	if len(scopes) == 0 {
+		return referenceUsage(ctx, d, referenceID, hardLimits)
+	}
+
+	scoped, ok := d.(ScopedDriver)
+	if !ok {
+		return referenceUsage(ctx, d, referenceID, hardLimits)
+	}
+
+	total := types.ResourceList{}
+	for _, scope := range scopes {
+		usage, err := usageForScope(ctx, scoped, referenceID, scope)
+		if err != nil {
+			return nil, err
+		}
+		total = types.Add(total, usage)
+	}
+
+	return total, nil
+}
+
+// referenceUsage returns the reference-wide usage of referenceID,
+// resolved per hard-limit resource name: a name covered by a registered
+// evaluator is computed by summing that evaluator's Usage, and a name
+// with no evaluator registered falls back to the driver's CalculateUsage,
+// exactly as if evaluators didn't exist. This per-name fallback, rather
+// than an all-or-nothing switch on "some evaluator is registered", is
+// what lets adding a new countable resource stay a one-evaluator
+// registration: any hard limit the new evaluator doesn't cover keeps
+// being served by the driver.
+func referenceUsage(ctx context.Context, d driver.Driver, referenceID string, hardLimits types.ResourceList) (types.ResourceList, error) {
+	names := hardLimitNames(hardLimits)
+	matched := evaluator.Match(names)
+
+	total := types.ResourceList{}
+	seen := make(map[evaluator.Evaluator]bool, len(matched))
+	var uncovered []types.ResourceName
+
+	for _, name := range names {
+		e, ok := matched[name]
+		if !ok {
+			uncovered = append(uncovered, name)
+			continue
+		}
+		if seen[e] {
+			continue
+		}
+		seen[e] = true
+
+		usage, err := e.Usage(ctx, referenceID)
+		if err != nil {
+			return nil, err
+		}
+		total = types.Add(total, usage)
+	}
+
+	if len(uncovered) == 0 {
+		return total, nil
+	}
+
+	if len(seen) == 0 {
+		// no hard limit was covered by an evaluator, so this is exactly
+		// the pre-evaluator behavior: the driver computes everything.
+		return d.CalculateUsage(ctx, referenceID)
+	}
+
+	driverUsage, err := d.CalculateUsage(ctx, referenceID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range uncovered {
+		if v, ok := driverUsage[name]; ok {
+			total[name] = v
+		}
+	}
+
+	return total, nil
+}
@@ -0,0 +1,123 @@
+// Copyright Project Harbor Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"context"
+	"testing"
+)
+
+type fakeSubject struct {
+	mediaType  string
+	repository string
+	signed     bool
+}
+
+func (s fakeSubject) MediaType() string          { return s.mediaType }
+func (s fakeSubject) RepositoryFullName() string { return s.repository }
+func (s fakeSubject) IsSigned() bool             { return s.signed }
+
+func boolPtr(b bool) *bool { return &b }
+
+func TestScopeMatches(t *testing.T) {
+	subject := fakeSubject{mediaType: "application/vnd.oci.image.manifest.v1+json", repository: "library/nginx", signed: true}
+
+	cases := []struct {
+		name  string
+		scope Scope
+		want  bool
+	}{
+		{"zero scope matches everything", Scope{}, true},
+		{"matching media type", Scope{MediaType: subject.mediaType}, true},
+		{"mismatching media type", Scope{MediaType: "application/vnd.docker.distribution.manifest.v2+json"}, false},
+		{"matching repository prefix", Scope{RepositoryPrefix: "library/"}, true},
+		{"mismatching repository prefix", Scope{RepositoryPrefix: "other/"}, false},
+		{"matching signed", Scope{Signed: boolPtr(true)}, true},
+		{"mismatching signed", Scope{Signed: boolPtr(false)}, false},
+		{"all fields match", Scope{MediaType: subject.mediaType, RepositoryPrefix: "library/", Signed: boolPtr(true)}, true},
+		{"one field mismatches", Scope{MediaType: subject.mediaType, RepositoryPrefix: "other/"}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.scope.Matches(subject); got != c.want {
+				t.Errorf("Scope%+v.Matches(%+v) = %v, want %v", c.scope, subject, got, c.want)
+			}
+		})
+	}
+}
+
+func TestQuotaAppliesToSubject(t *testing.T) {
+	subject := fakeSubject{mediaType: "application/vnd.oci.image.manifest.v1+json", repository: "library/nginx"}
+
+	cases := []struct {
+		name    string
+		scopes  []Scope
+		subject ScopeSubject
+		want    bool
+	}{
+		{"no scopes always applies", nil, subject, true},
+		{"matches one of several scopes", []Scope{{RepositoryPrefix: "other/"}, {RepositoryPrefix: "library/"}}, subject, true},
+		{"matches none of the scopes", []Scope{{RepositoryPrefix: "other/"}}, subject, false},
+		{"scoped quota with no subject is skipped", []Scope{{RepositoryPrefix: "library/"}}, nil, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := quotaAppliesToSubject(c.scopes, c.subject); got != c.want {
+				t.Errorf("quotaAppliesToSubject(%+v, %+v) = %v, want %v", c.scopes, c.subject, got, c.want)
+			}
+		})
+	}
+}
+
+func TestSetScopesRefusesWhileUnenforceable(t *testing.T) {
+	c := &controller{}
+
+	// Guard against accidentally flipping scopesEnforceable on without
+	// also updating this test and actually migrating a call site.
+	if scopesEnforceable {
+		t.Fatal("scopesEnforceable is true, but no call site in this codebase supplies a ScopeSubject yet - update this test once one does")
+	}
+
+	if err := c.SetScopes(context.Background(), 1, Scope{RepositoryPrefix: "library/"}); err == nil {
+		t.Fatal("SetScopes with a non-empty scope = nil error, want a refusal while scopes aren't enforceable")
+	}
+}
+
+func TestValidateScopesDisjoint(t *testing.T) {
+	cases := []struct {
+		name    string
+		scopes  []Scope
+		wantErr bool
+	}{
+		{"empty", nil, false},
+		{"single scope", []Scope{{RepositoryPrefix: "library/"}}, false},
+		{"disjoint media types", []Scope{{MediaType: "a"}, {MediaType: "b"}}, false},
+		{"disjoint repository prefixes", []Scope{{RepositoryPrefix: "library/"}, {RepositoryPrefix: "other/"}}, false},
+		{"overlapping: one prefix extends the other", []Scope{{RepositoryPrefix: "library/"}, {RepositoryPrefix: "library/nginx"}}, true},
+		{"overlapping: unset fields are wildcards", []Scope{{MediaType: "a"}, {RepositoryPrefix: "library/"}}, true},
+		{"disjoint via signed", []Scope{{Signed: boolPtr(true)}, {Signed: boolPtr(false)}}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateScopesDisjoint(c.scopes)
+			if (err != nil) != c.wantErr {
+				t.Errorf("validateScopesDisjoint(%+v) error = %v, wantErr %v", c.scopes, err, c.wantErr)
+			}
+		})
+	}
+}
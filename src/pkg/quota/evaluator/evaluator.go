@@ -0,0 +1,92 @@
+// Copyright Project Harbor Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package evaluator lets a quota driver delegate the computation of
+// individual countable resources (artifacts, blobs, repositories, tags,
+// ...) to one Evaluator per resource kind, instead of a single
+// driver.Driver.CalculateUsage having to account for everything itself.
+// It is modeled on the Kubernetes quota.Registry of per-GroupResource
+// evaluators.
+package evaluator
+
+import (
+	"context"
+
+	"github.com/goharbor/harbor/src/pkg/quota/types"
+)
+
+// Evaluator computes the usage contributed by one kind of countable
+// resource for a reference. A driver no longer needs to know every
+// resource it tracks; it only needs to know which evaluators to consult.
+type Evaluator interface {
+	// Usage returns the usage this evaluator contributes for referenceID.
+	Usage(ctx context.Context, referenceID string) (types.ResourceList, error)
+
+	// MatchingResources returns the subset of names this evaluator knows
+	// how to compute usage for.
+	MatchingResources(names []types.ResourceName) []types.ResourceName
+}
+
+var registry = map[types.ResourceName]Evaluator{}
+
+// Register registers the evaluator responsible for kind. Adding a new
+// countable resource is therefore a one-evaluator registration rather
+// than an edit to every driver's CalculateUsage. Registering the same
+// kind twice overwrites the previous registration.
+func Register(kind types.ResourceName, e Evaluator) {
+	registry[kind] = e
+}
+
+// Get returns the evaluator registered for kind, if any.
+func Get(kind types.ResourceName) (Evaluator, bool) {
+	e, ok := registry[kind]
+	return e, ok
+}
+
+// List returns, without duplicates, every evaluator registered for a
+// resource in names.
+func List(names []types.ResourceName) []Evaluator {
+	seen := make(map[Evaluator]bool)
+	var evaluators []Evaluator
+
+	for _, name := range names {
+		e, ok := registry[name]
+		if !ok || seen[e] {
+			continue
+		}
+
+		seen[e] = true
+		evaluators = append(evaluators, e)
+	}
+
+	return evaluators
+}
+
+// Match returns, for every name in names that some registered evaluator
+// covers, the evaluator responsible for it. Coverage is decided by each
+// candidate evaluator's own MatchingResources rather than by the registry
+// lookup alone, so a caller can tell exactly which names still need to
+// fall back to something else (e.g. a driver's CalculateUsage) instead of
+// treating "some evaluator is registered" as "every name is covered".
+func Match(names []types.ResourceName) map[types.ResourceName]Evaluator {
+	matched := make(map[types.ResourceName]Evaluator, len(names))
+
+	for _, e := range List(names) {
+		for _, name := range e.MatchingResources(names) {
+			matched[name] = e
+		}
+	}
+
+	return matched
+}